@@ -1,19 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/dustin/gomemcached"
-	"github.com/dustin/gomemcached/client"
 )
 
 type BlobOwnership struct {
@@ -21,25 +23,51 @@ type BlobOwnership struct {
 	Length int64                `json:"length"`
 	Nodes  map[string]time.Time `json:"nodes"`
 	Type   string               `json:"type"`
+	// MinRepl and MaxRepl override globalConfig.MinReplicas/MaxReplicas
+	// for this specific blob. 0 means "use the global default".
+	MinRepl int `json:"minRepl,omitempty"`
+	MaxRepl int `json:"maxRepl,omitempty"`
+	// ContentType is the MIME type given at upload time, used to decide
+	// whether this blob is worth compressing.
+	ContentType string `json:"contentType,omitempty"`
+	// Compression is the encoding ("", "gzip", or "zstd") the blob is
+	// actually stored in on disk. OID is always the hash of the
+	// uncompressed bytes, so this can change (via the re-encoder task)
+	// without affecting dedup.
+	Compression string `json:"compression,omitempty"`
 }
 
-type internodeCommand uint8
-
-const (
-	removeObjectCmd = internodeCommand(iota)
-	acquireObjectCmd
-	fetchObjectCmd
-)
+// RecordOpts carries the optional fields of a BlobOwnership record.
+// Copies and ContentType are only set at upload time; Compression is
+// also set when a fetched or re-encoded blob changes its on-disk
+// encoding. A zero field leaves whatever was previously recorded alone,
+// and the zero value is what replication-driven calls to
+// recordBlobOwnership pass.
+type RecordOpts struct {
+	Copies      int
+	ContentType string
+	Compression string
+}
 
-type internodeTask struct {
-	node     StorageNode
-	cmd      internodeCommand
-	oid      string
-	prevNode string
+// minReplicas is the desired minimum replica count for this blob,
+// falling back to the cluster-wide default when no override was given
+// at upload time.
+func (b BlobOwnership) minReplicas() int {
+	if b.MinRepl > 0 {
+		return b.MinRepl
+	}
+	return globalConfig.MinReplicas
 }
 
-var taskWorkers = flag.Int("taskWorkers", 4,
-	"Number of blob move/removal workers.")
+// maxReplicas is the desired maximum replica count for this blob,
+// falling back to the cluster-wide default when no override was given
+// at upload time.
+func (b BlobOwnership) maxReplicas() int {
+	if b.MaxRepl > 0 {
+		return b.MaxRepl
+	}
+	return globalConfig.MaxReplicas
+}
 
 func (b BlobOwnership) ResolveNodes() NodeList {
 	keys := make([]string, 0, len(b.Nodes))
@@ -88,62 +116,187 @@ func (b BlobOwnership) ResolveRemoteNodes() NodeList {
 func getBlobOwnership(oid string) (BlobOwnership, error) {
 	rv := BlobOwnership{}
 	oidkey := "/" + oid
-	err := couchbase.Get(oidkey, &rv)
+	err := metaStore.Get(oidkey, &rv)
 	return rv, err
 }
 
-func copyBlob(w io.Writer, oid string) error {
+// copyBlob writes oid to w, serving it in the best encoding acceptable
+// to acceptEncoding (an HTTP Accept-Encoding header value), and
+// returns the Content-Encoding the caller should advertise for what it
+// wrote ("" for identity).
+func copyBlob(ctx context.Context, w io.Writer, oid string, acceptEncoding string) (string, error) {
+	ownership, ownErr := getBlobOwnership(oid)
+	stored := ""
+	if ownErr == nil {
+		stored = ownership.Compression
+	}
+
 	f, err := openBlob(oid)
 	if err == nil {
 		// Doing it locally
 		defer f.Close()
-		_, err = io.Copy(w, f)
-		return err
+		if stored == "" || acceptsEncoding(acceptEncoding, stored) {
+			_, err = io.Copy(w, f)
+			return stored, err
+		}
+		// Client can't take what we have on disk -- decompress on
+		// the fly rather than failing the request.
+		dr, err := decompressReader(f, stored)
+		if err != nil {
+			return "", err
+		}
+		defer dr.Close()
+		_, err = io.Copy(w, dr)
+		return "", err
 	} else {
 		// Doing it remotely
 		c := captureResponseWriter{w: w}
-		return getBlobFromRemote(&c, oid, http.Header{}, *cachePercentage)
+		header := http.Header{}
+		if acceptEncoding != "" {
+			header.Set("Accept-Encoding", acceptEncoding)
+		}
+		err := getBlobFromRemote(ctx, &c, oid, header, *cachePercentage)
+		return c.header.Get("Content-Encoding"), err
 	}
 	panic("unreachable")
 }
 
-func recordBlobOwnership(h string, l int64, force bool) error {
+// recordBlobOwnership records this node as an owner of h. opts'
+// Copies, when greater than zero, pins this blob's desired replica
+// count (overriding globalConfig.MinReplicas/MaxReplicas); a non-empty
+// ContentType/Compression is recorded the same way. A zero field leaves
+// the recorded value alone, so calls that only add an owner (e.g. from
+// replication) pass the zero RecordOpts. When force is false and the
+// record already lists this node, nothing is written, opts included.
+func recordBlobOwnership(h string, l int64, force bool, opts RecordOpts) error {
 	k := "/" + h
-	err := couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
-		_, err := mc.CAS(vb, k, func(in []byte) ([]byte, memcached.CasOp) {
-			ownership := BlobOwnership{}
-			err := json.Unmarshal(in, &ownership)
-			if err == nil {
-				if _, ok := ownership.Nodes[serverId]; ok && !force {
-					// Skip it fast if it already knows us
-					return nil, memcached.CASQuit
-				}
-				ownership.Nodes[serverId] = time.Now().UTC()
-			} else {
-				ownership.Nodes = map[string]time.Time{
-					serverId: time.Now().UTC(),
-				}
+	return metaStore.CAS(k, func(in []byte) ([]byte, CasOp) {
+		ownership := BlobOwnership{}
+		err := json.Unmarshal(in, &ownership)
+		if err == nil {
+			if _, ok := ownership.Nodes[serverId]; ok && !force {
+				// Skip it fast if it already knows us
+				return nil, CASQuit
 			}
-			ownership.OID = h
-			ownership.Length = l
-			ownership.Type = "blob"
-			return mustEncode(&ownership), memcached.CASStore
-		}, 0)
-		return err
+			ownership.Nodes[serverId] = time.Now().UTC()
+		} else {
+			ownership.Nodes = map[string]time.Time{
+				serverId: time.Now().UTC(),
+			}
+		}
+		if opts.Copies > 0 {
+			ownership.MinRepl = opts.Copies
+			ownership.MaxRepl = opts.Copies
+		}
+		if opts.ContentType != "" {
+			ownership.ContentType = opts.ContentType
+		}
+		if opts.Compression != "" {
+			ownership.Compression = opts.Compression
+		}
+		ownership.OID = h
+		ownership.Length = l
+		ownership.Type = "blob"
+		return mustEncode(&ownership), CASStore
 	})
-	if err == memcached.CASQuit {
-		err = nil
+}
+
+// desiredCopiesFromRequest extracts the upload-time replica-count
+// override from a PUT request: the "copies" query parameter, falling
+// back to an X-CBFS-Copies header for callers that don't forward query
+// strings. It returns 0 ("use the cluster default") if neither is
+// present or doesn't parse as a positive integer.
+func desiredCopiesFromRequest(req *http.Request) int {
+	v := req.FormValue("copies")
+	if v == "" {
+		v = req.Header.Get("X-CBFS-Copies")
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// doPutBlob handles the client upload path (PUT /<name>): it hashes
+// and stores req.Body locally, picking the on-disk encoding via
+// pickEncoding so a freshly uploaded blob is compressed up front
+// instead of waiting on the background re-encoder, then records
+// ownership with whatever upload-time overrides the request carried,
+// so a caller can demand, say, 5 copies of a critical blob and 1 of a
+// cache blob via ?copies=N.
+func doPutBlob(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
-	return err
+
+	contentType := req.Header.Get("Content-Type")
+	enc := pickEncoding(contentType)
+
+	tmp, err := ioutil.TempFile(*root, "upload-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	cw, err := compressWriter(tmp, enc)
+	if err != nil {
+		tmp.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha1.New()
+	_, copyErr := io.Copy(cw, io.TeeReader(req.Body, hash))
+	closeErr := cw.Close()
+	if copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		tmp.Close()
+		http.Error(w, copyErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	oid := fmt.Sprintf("%x", hash.Sum(nil))
+	if err := os.Rename(tmpPath, hashFilename(*root, oid)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	st, err := os.Stat(hashFilename(*root, oid))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := recordBlobOwnership(oid, st.Size(), true, RecordOpts{
+		Copies:      desiredCopiesFromRequest(req),
+		ContentType: contentType,
+		Compression: enc,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"oid": oid})
 }
 
 func recordBlobAccess(h string) {
-	_, err := couchbase.Incr("/"+h+"/r", 1, 1, 0)
+	_, err := metaStore.Incr("/"+h+"/r", 1, 1)
 	if err != nil {
 		log.Printf("Error incrementing counter for %v: %v", h, err)
 	}
 
-	_, err = couchbase.Incr("/"+serverId+"/r", 1, 1, 0)
+	_, err = metaStore.Incr("/"+serverId+"/r", 1, 1)
 	if err != nil {
 		log.Printf("Error incrementing node identifier: %v", err)
 	}
@@ -155,44 +308,41 @@ func removeBlobOwnershipRecord(h, node string) int {
 	numOwners := -1
 
 	k := "/" + h
-	err := couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
-		_, err := mc.CAS(vb, k, func(in []byte) ([]byte, memcached.CasOp) {
-			ownership := BlobOwnership{}
+	err := metaStore.CAS(k, func(in []byte) ([]byte, CasOp) {
+		ownership := BlobOwnership{}
 
-			if len(in) == 0 {
-				return nil, memcached.CASQuit
-			}
+		if len(in) == 0 {
+			return nil, CASQuit
+		}
 
-			err := json.Unmarshal(in, &ownership)
-			if err == nil {
-				delete(ownership.Nodes, node)
-			} else {
-				log.Printf("Error unmarhaling blob removal from %s: %v",
-					in, err)
-				return nil, memcached.CASQuit
-			}
+		err := json.Unmarshal(in, &ownership)
+		if err == nil {
+			delete(ownership.Nodes, node)
+		} else {
+			log.Printf("Error unmarhaling blob removal from %s: %v",
+				in, err)
+			return nil, CASQuit
+		}
 
-			var rv []byte
-			op := memcached.CASStore
+		var rv []byte
+		op := CASStore
 
-			numOwners = len(ownership.Nodes)
+		numOwners = len(ownership.Nodes)
 
-			if len(ownership.Nodes) == 0 && node == serverId {
-				op = memcached.CASDelete
-			} else {
-				rv = mustEncode(&ownership)
-			}
+		if len(ownership.Nodes) == 0 && node == serverId {
+			op = CASDelete
+		} else {
+			rv = mustEncode(&ownership)
+		}
 
-			return rv, op
-		}, 0)
-		return err
+		return rv, op
 	})
-	if err != nil && err != memcached.CASQuit {
+	if err != nil {
 		log.Printf("Error cleaning %v from %v: %v", node, h, err)
 		numOwners = -1
 	}
 	if numOwners == 0 {
-		couchbase.Delete(k + "/r")
+		metaStore.Delete(k + "/r")
 	}
 
 	return numOwners
@@ -203,58 +353,55 @@ func maybeRemoveBlobOwnership(h string) (rv error) {
 
 	k := "/" + h
 	removedLast := false
-	err := couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
-		_, err := mc.CAS(vb, k, func(in []byte) ([]byte, memcached.CasOp) {
-			ownership := BlobOwnership{}
-			removedLast = false
+	err := metaStore.CAS(k, func(in []byte) ([]byte, CasOp) {
+		ownership := BlobOwnership{}
+		removedLast = false
 
-			if len(in) == 0 {
-				return nil, memcached.CASQuit
-			}
+		if len(in) == 0 {
+			return nil, CASQuit
+		}
 
-			err := json.Unmarshal(in, &ownership)
-			if err == nil {
-				if time.Since(ownership.Nodes[serverId]) < time.Hour {
-					rv = errors.New("too soon")
-					return nil, memcached.CASQuit
-				}
-				if len(ownership.Nodes)-1 < globalConfig.MinReplicas {
-					rv = errors.New("Insufficient replicas")
-					return nil, memcached.CASQuit
-				}
-				delete(ownership.Nodes, serverId)
-			} else {
-				log.Printf("Error unmarhaling blob removal from %s: %v",
-					in, err)
-				rv = err
-				return nil, memcached.CASQuit
+		err := json.Unmarshal(in, &ownership)
+		if err == nil {
+			if time.Since(ownership.Nodes[serverId]) < time.Hour {
+				rv = errors.New("too soon")
+				return nil, CASQuit
+			}
+			if len(ownership.Nodes)-1 < ownership.minReplicas() {
+				rv = errors.New("Insufficient replicas")
+				return nil, CASQuit
 			}
+			delete(ownership.Nodes, serverId)
+		} else {
+			log.Printf("Error unmarhaling blob removal from %s: %v",
+				in, err)
+			rv = err
+			return nil, CASQuit
+		}
 
-			var newv []byte
-			op := memcached.CASStore
+		var newv []byte
+		op := CASStore
 
-			if len(ownership.Nodes) == 0 {
-				removedLast = true
-				op = memcached.CASDelete
-			} else {
-				newv = mustEncode(&ownership)
-			}
+		if len(ownership.Nodes) == 0 {
+			removedLast = true
+			op = CASDelete
+		} else {
+			newv = mustEncode(&ownership)
+		}
 
-			return newv, op
-		}, 0)
-		return err
+		return newv, op
 	})
-	if err != nil && err != memcached.CASQuit {
+	if err != nil {
 		log.Printf("Error cleaning %v: %v", h, err)
 	}
 	if removedLast {
-		couchbase.Delete(k + "/r")
+		metaStore.Delete(k + "/r")
 	}
 
 	return
 }
 
-func increaseReplicaCount(oid string, length int64, by int) error {
+func increaseReplicaCount(ctx context.Context, oid string, length int64, by int) error {
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
@@ -265,18 +412,22 @@ func increaseReplicaCount(oid string, length int64, by int) error {
 	}
 	for _, n := range onto {
 		log.Printf("Asking %v to acquire %v", n, oid)
-		queueBlobAcquire(n, oid, "")
+		if err := queueBlobAcquire(ctx, PriorityNormal, n, oid, ""); err != nil {
+			log.Printf("Couldn't queue acquire of %v on %v: %v", oid, n, err)
+		}
 	}
 	return nil
 }
 
 func ensureMinimumReplicaCount() error {
+	ctx, cancel := registerAdminTask("ensureMinReplCount")
+	defer cancel()
 	return runMarkedTask("ensureMinReplCount",
 		[]string{"garbageCollectBlobs", "trimFullNodes"},
-		ensureMinimumReplicaCountTask)
+		func() error { return ensureMinimumReplicaCountTask(ctx) })
 }
 
-func ensureMinimumReplicaCountTask() error {
+func ensureMinimumReplicaCountTask(ctx context.Context) error {
 	// Don't let this run concurrently with the garbage collector.
 	// They don't get along.
 	for taskRunning("garbageCollectBlobs") {
@@ -289,50 +440,45 @@ func ensureMinimumReplicaCountTask() error {
 		return err
 	}
 
-	viewRes := struct {
-		Rows []struct {
-			Id string
-		}
-	}{}
-
-	// Don't bother trying to replicate to more nodes than exist.
-	endKey := globalConfig.MinReplicas - 1
-	if globalConfig.MinReplicas > len(nl) {
-		endKey = len(nl) - 1
-	}
+	// Only debts of 1 through len(nl)-1 are scanned. A blob whose debt
+	// is len(nl) or more (its desired count exceeds its actual count by
+	// at least the number of nodes) is not picked up by this scan.
+	endKey := len(nl) - 1
 
-	// Find some less replicated docs to suck in.
-	err = couchbase.ViewCustom("cbfs", "repcounts",
-		map[string]interface{}{
-			"reduce":   false,
-			"limit":    globalConfig.ReplicationCheckLimit,
-			"startkey": 1,
-			"endkey":   endKey,
-			"stale":    false,
-		},
-		&viewRes)
+	// Find some under-replicated docs (desired minus actual >= 1) to
+	// suck in. Each blob's desired count may be its own MinRepl
+	// override rather than globalConfig.MinReplicas.
+	rows, err := metaStore.Range(RangeQuery{
+		Dimension: "debt",
+		StartKey:  1,
+		EndKey:    endKey,
+		Limit:     globalConfig.ReplicationCheckLimit,
+	})
 
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Increasing replica count of %v items",
-		len(viewRes.Rows))
+	log.Printf("Increasing replica count of %v items", len(rows))
 
-	for _, r := range viewRes.Rows {
-		salvageBlob(r.Id[1:], "", nl)
+	for _, r := range rows {
+		if ctx.Err() != nil {
+			log.Printf("ensureMinReplCount cancelled, stopping early")
+			return ctx.Err()
+		}
+		salvageBlob(ctx, r.ID[1:], "", nl)
 	}
 	return nil
 }
 
-func pruneBlob(oid string, nodemap map[string]string, nl NodeList) {
-	if len(nodemap) <= globalConfig.MaxReplicas {
+func pruneBlob(ctx context.Context, oid string, nodemap map[string]time.Time, maxReplicas int, nl NodeList) {
+	if len(nodemap) <= maxReplicas {
 		log.Printf("Asked to prune a blob that has too few replicas: %v",
 			oid)
 	}
 
 	log.Printf("Pruning blob %v down from %v repls to %v",
-		oid, len(nodemap), globalConfig.MaxReplicas)
+		oid, len(nodemap), maxReplicas)
 
 	nm := map[string]StorageNode{}
 	for _, n := range nl {
@@ -341,60 +487,65 @@ func pruneBlob(oid string, nodemap map[string]string, nl NodeList) {
 
 	remaining := len(nodemap)
 	for n := range nodemap {
-		if remaining <= globalConfig.MaxReplicas {
+		if remaining <= maxReplicas {
 			break
 		}
 		remaining--
 		if sn, ok := nm[n]; ok {
-			queueBlobRemoval(sn, oid)
+			if err := queueBlobRemoval(ctx, PriorityBackground, sn, oid); err != nil {
+				log.Printf("Couldn't queue removal of %v from %v: %v", oid, sn, err)
+			}
 		}
 	}
 
 }
 
 func pruneExcessiveReplicas() error {
+	ctx, cancel := registerAdminTask("pruneExcessiveReplicas")
+	defer cancel()
+	return pruneExcessiveReplicasTask(ctx)
+}
+
+func pruneExcessiveReplicasTask(ctx context.Context) error {
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
 	}
 
-	viewRes := struct {
-		Rows []struct {
-			Id  string
-			Doc struct {
-				Json struct {
-					Nodes map[string]string
-				}
-			}
-		}
-	}{}
-
-	// Find some less replicated docs to suck in.
-	err = couchbase.ViewCustom("cbfs", "repcounts",
-		map[string]interface{}{
-			"descending":   true,
-			"reduce":       false,
-			"include_docs": true,
-			"limit":        globalConfig.ReplicationCheckLimit,
-			"endkey":       globalConfig.MaxReplicas + 1,
-			"stale":        false,
-		},
-		&viewRes)
+	// Find some over-replicated docs (actual minus desired >= 1) to
+	// trim. There's no upper bound on surplus, so StartKey just needs
+	// to be high enough to cover every real one.
+	rows, err := metaStore.Range(RangeQuery{
+		Dimension:   "surplus",
+		StartKey:    unboundedRangeKey,
+		EndKey:      1,
+		Limit:       globalConfig.ReplicationCheckLimit,
+		Descending:  true,
+		IncludeDocs: true,
+	})
 
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Decreasing replica count of %v items",
-		len(viewRes.Rows))
+	log.Printf("Decreasing replica count of %v items", len(rows))
 
 	// Short-circuit when there's nothing to clean
-	if len(viewRes.Rows) == 0 {
+	if len(rows) == 0 {
 		return nil
 	}
 
-	for _, r := range viewRes.Rows {
-		pruneBlob(r.Id[1:], r.Doc.Json.Nodes, nl)
+	for _, r := range rows {
+		if ctx.Err() != nil {
+			log.Printf("pruneExcessiveReplicas cancelled, stopping early")
+			return ctx.Err()
+		}
+		ownership := BlobOwnership{}
+		if err := json.Unmarshal(r.Doc, &ownership); err != nil {
+			log.Printf("Error unmarshaling repcounts doc for %v: %v", r.ID, err)
+			continue
+		}
+		pruneBlob(ctx, r.ID[1:], ownership.Nodes, ownership.maxReplicas(), nl)
 	}
 	return nil
 }
@@ -404,13 +555,13 @@ func hasBlob(oid string) bool {
 	return err == nil
 }
 
-func performFetch(oid, prev string) {
+func performFetch(ctx context.Context, oid, prev string) {
 	c := captureResponseWriter{w: ioutil.Discard}
 
 	// If we already have it, we don't need it more.
 	st, err := os.Stat(hashFilename(*root, oid))
 	if err == nil {
-		err = recordBlobOwnership(oid, st.Size(), false)
+		err = recordBlobOwnership(oid, st.Size(), false, RecordOpts{})
 		if err != nil {
 			log.Printf("Error recording fetched blob: %v",
 				err)
@@ -418,9 +569,21 @@ func performFetch(oid, prev string) {
 		return
 	}
 
-	err = getBlobFromRemote(&c, oid, http.Header{}, 100)
+	// Ask for our preferred encoding so a peer that already holds this
+	// blob compressed can stream the compressed bytes straight to
+	// disk instead of decompressing and recompressing it.
+	fetchHeader := http.Header{"Accept-Encoding": []string{acceptEncodingHeader()}}
+	err = getBlobFromRemote(ctx, &c, oid, fetchHeader, 100)
 
 	if err == nil && c.statusCode == 200 {
+		if enc := c.header.Get("Content-Encoding"); enc != "" {
+			if fst, serr := os.Stat(hashFilename(*root, oid)); serr == nil {
+				if rerr := recordBlobOwnership(oid, fst.Size(), false,
+					RecordOpts{Compression: enc}); rerr != nil {
+					log.Printf("Error recording fetched blob compression: %v", rerr)
+				}
+			}
+		}
 		if prev != "" {
 			log.Printf("Removing ownership of %v from %v after takeover",
 				oid, prev)
@@ -431,7 +594,9 @@ func performFetch(oid, prev string) {
 			} else {
 				log.Printf("Forcing post-move blob removal of %v from %v",
 					oid, n)
-				queueBlobRemoval(n, oid)
+				if err := queueBlobRemoval(ctx, PriorityNormal, n, oid); err != nil {
+					log.Printf("Couldn't queue removal of %v from %v: %v", oid, n, err)
+				}
 			}
 		}
 	} else {
@@ -440,76 +605,23 @@ func performFetch(oid, prev string) {
 	}
 }
 
-func salvageBlob(oid, deadNode string, nl NodeList) {
+// salvageBlob asks the best candidate node to acquire oid, queueing the
+// request on this node's PriorityCritical lane. If the enqueue fails
+// (the lane is full), it tries the next candidate rather than blocking.
+// The lane is this node's own queue, shared by every candidate, so a
+// full lane fails each candidate alike unless a worker drains it in
+// between.
+func salvageBlob(ctx context.Context, oid, deadNode string, nl NodeList) {
 	candidates := nl.candidatesFor(oid,
 		NodeList{nl.named(deadNode)})
 
-	if len(candidates) == 0 {
-		log.Printf("Couldn't find a candidate for blob!")
-	} else {
-		log.Printf("Recommending %v get a copy of %v",
-			candidates[0], oid)
-		queueBlobAcquire(candidates[0], oid, deadNode)
-	}
-}
-
-var internodeTaskQueue = make(chan internodeTask, 1000)
-
-func internodeTaskWorker() {
-	for c := range internodeTaskQueue {
-		switch c.cmd {
-		case removeObjectCmd:
-			if err := c.node.deleteBlob(c.oid); err != nil {
-				log.Printf("Error deleting %v from %v: %v",
-					c.oid, c.node, err)
-				if c.node.IsDead() {
-					log.Printf("Node is dead, cleaning")
-					removeBlobOwnershipRecord(c.oid,
-						c.node.name)
-				}
-			}
-		case acquireObjectCmd:
-			if err := c.node.acquireBlob(c.oid, c.prevNode); err != nil {
-				log.Printf("Error acquiring %v from %v: %v",
-					c.oid, c.node, err)
-			}
-		case fetchObjectCmd:
-			performFetch(c.oid, c.prevNode)
-		default:
-			log.Fatalf("Unhandled worker task: %v", c)
+	for _, candidate := range candidates {
+		err := queueBlobAcquire(ctx, PriorityCritical, candidate, oid, deadNode)
+		if err == nil {
+			log.Printf("Recommending %v get a copy of %v", candidate, oid)
+			return
 		}
+		log.Printf("Couldn't queue acquire on %v (%v), trying next candidate", candidate, err)
 	}
-}
-
-func initTaskQueueWorkers() {
-	for i := 0; i < *taskWorkers; i++ {
-		go internodeTaskWorker()
-	}
-}
-
-func queueBlobRemoval(n StorageNode, oid string) {
-	internodeTaskQueue <- internodeTask{
-		node: n,
-		cmd:  removeObjectCmd,
-		oid:  oid,
-	}
-}
-
-// Ask a remote node to go get a blob
-func queueBlobAcquire(n StorageNode, oid string, prev string) {
-	internodeTaskQueue <- internodeTask{
-		node:     n,
-		cmd:      acquireObjectCmd,
-		oid:      oid,
-		prevNode: prev,
-	}
-}
-
-// Ask this node to go get a blob
-func queueBlobFetch(oid, prev string) {
-	internodeTaskQueue <- internodeTask{
-		cmd:      fetchObjectCmd,
-		oid:      oid,
-		prevNode: prev,
-	}
+	log.Printf("Couldn't find a candidate for blob!")
 }
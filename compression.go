@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var compressionAlgo = flag.String("compression", "zstd",
+	"Compression to use for new blobs that qualify (zstd, gzip, or none).")
+
+// noCompressMimePrefixes are content-type prefixes that are already
+// compressed in practice (images, video, audio), so spending CPU
+// compressing them again isn't worth it.
+var noCompressMimePrefixes = []string{"image/", "video/", "audio/"}
+
+// noCompressMimeTypes are exact content types for already-compressed
+// container/archive formats.
+var noCompressMimeTypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/zstd":             true,
+}
+
+// shouldCompress reports whether a blob with the given content type is
+// worth running through our compression policy at all.
+func shouldCompress(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	ct := strings.ToLower(strings.TrimSpace(contentType))
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	if noCompressMimeTypes[ct] {
+		return false
+	}
+	for _, prefix := range noCompressMimePrefixes {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// pickEncoding returns the encoding a new blob of the given content
+// type should be stored with: "" means store it uncompressed.
+func pickEncoding(contentType string) string {
+	if *compressionAlgo == "none" || !shouldCompress(contentType) {
+		return ""
+	}
+	return *compressionAlgo
+}
+
+// acceptEncodingHeader builds the Accept-Encoding value this node
+// should send when fetching a blob from a peer, preferring whatever it
+// would store new blobs as.
+func acceptEncodingHeader() string {
+	switch *compressionAlgo {
+	case "zstd":
+		return "zstd, gzip"
+	case "gzip":
+		return "gzip"
+	default:
+		return "identity"
+	}
+}
+
+// acceptsEncoding reports whether the given Accept-Encoding header
+// value permits serving content in enc.
+func acceptsEncoding(acceptEncoding, enc string) bool {
+	if enc == "" {
+		return true
+	}
+	for _, tok := range strings.Split(acceptEncoding, ",") {
+		tok = strings.TrimSpace(strings.SplitN(tok, ";", 2)[0])
+		if tok == enc || tok == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func compressWriter(w io.Writer, enc string) (io.WriteCloser, error) {
+	switch enc {
+	case "":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression %q", enc)
+	}
+}
+
+func decompressReader(r io.Reader, enc string) (io.ReadCloser, error) {
+	switch enc {
+	case "":
+		return ioutilNopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", enc)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+type nopReadCloser struct{ io.Reader }
+
+func (nopReadCloser) Close() error { return nil }
+
+func ioutilNopCloser(r io.Reader) io.ReadCloser { return nopReadCloser{r} }
+
+func reencodeBlobs() error {
+	ctx, cancel := registerAdminTask("reencodeBlobs")
+	defer cancel()
+	return runMarkedTask("reencodeBlobs",
+		[]string{"garbageCollectBlobs"},
+		func() error { return reencodeBlobsTask(ctx) })
+}
+
+// reencodeBlobsTask walks every blob this node stores locally and
+// upgrades any whose on-disk encoding doesn't match what pickEncoding
+// would choose for it today, without changing their OID (which is
+// always the hash of the uncompressed content, so dedup is
+// unaffected).
+func reencodeBlobsTask(ctx context.Context) error {
+	n := 0
+	err := filepath.Walk(*root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		oid := filepath.Base(path)
+		ownership, err := getBlobOwnership(oid)
+		if err != nil {
+			// Not a tracked blob (or metadata is unavailable) --
+			// leave it alone.
+			return nil
+		}
+		target := pickEncoding(ownership.ContentType)
+		if ownership.Compression == target {
+			return nil
+		}
+
+		if err := reencodeBlob(path, oid, ownership.Compression, target); err != nil {
+			log.Printf("Error re-encoding %v: %v", oid, err)
+			return nil
+		}
+		n++
+		return nil
+	})
+	log.Printf("Re-encoded %v blobs", n)
+	return err
+}
+
+// reencodeBlob rewrites the blob stored at path from oldEnc to newEnc
+// via a temp file + rename, then updates its ownership record.
+func reencodeBlob(path, oid, oldEnc, newEnc string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dr, err := decompressReader(bufio.NewReader(in), oldEnc)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), oid+".reencode-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	cw, err := compressWriter(tmp, newEnc)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := io.Copy(cw, dr); err != nil {
+		cw.Close()
+		tmp.Close()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return recordBlobOwnership(oid, st.Size(), true, RecordOpts{Compression: newEnc})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+)
+
+// badgerMetaStore is an embedded MetaStore backed by a local Badger
+// database, for single-node and small-cluster deployments that don't
+// want to stand up a couchbase cluster just to track blob ownership.
+//
+// Badger gives us durable key/value storage but no secondary indexes,
+// so replica debt/surplus are tracked in parallel "index" keyspaces
+// (repcount/debt/<n>/<oid>, repcount/surplus/<n>/<oid>) that are kept
+// in sync under the same CAS transaction used to update the ownership
+// record itself.
+type badgerMetaStore struct {
+	db *badger.DB
+	// mu serializes CAS so the read-modify-write + index update pair
+	// is atomic from the caller's point of view, mirroring the
+	// per-vbucket serialization couchbase gives us for free.
+	mu sync.Mutex
+}
+
+func newBadgerMetaStore(path string) (MetaStore, error) {
+	opts := badger.DefaultOptions(path)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &badgerMetaStore{db: db}, nil
+}
+
+func repcountIndexKey(dimension, oid string, n int) []byte {
+	return []byte("repcount/" + dimension + "/" + strconv.Itoa(n) + "/" + oid)
+}
+
+// replicaStats extracts an ownership record's replica debt and surplus
+// (each clamped to >= 0) along with its blob class, falling back to
+// zero values for a key that doesn't exist yet or doesn't decode.
+func replicaStats(doc []byte) (debt, surplus int, class string) {
+	ownership := BlobOwnership{}
+	if len(doc) == 0 || json.Unmarshal(doc, &ownership) != nil {
+		return 0, 0, ""
+	}
+	actual := len(ownership.Nodes)
+	if d := ownership.minReplicas() - actual; d > 0 {
+		debt = d
+	}
+	if s := actual - ownership.maxReplicas(); s > 0 {
+		surplus = s
+	}
+	return debt, surplus, ownership.Type
+}
+
+func (b *badgerMetaStore) CAS(key string, f func(in []byte) ([]byte, CasOp)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.db.Update(func(txn *badger.Txn) error {
+		var in []byte
+		item, err := txn.Get([]byte(key))
+		switch err {
+		case nil:
+			in, err = item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+		case badger.ErrKeyNotFound:
+			in = nil
+		default:
+			return err
+		}
+
+		out, op := f(in)
+		if op == CASQuit {
+			return nil
+		}
+
+		oldDebt, oldSurplus, _ := replicaStats(in)
+
+		switch op {
+		case CASDelete:
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err := txn.Delete(repcountIndexKey("debt", key, oldDebt)); err != nil {
+				return err
+			}
+			return txn.Delete(repcountIndexKey("surplus", key, oldSurplus))
+		default:
+			if err := txn.Set([]byte(key), out); err != nil {
+				return err
+			}
+			newDebt, newSurplus, _ := replicaStats(out)
+			if newDebt != oldDebt {
+				if err := txn.Delete(repcountIndexKey("debt", key, oldDebt)); err != nil {
+					return err
+				}
+			}
+			if newSurplus != oldSurplus {
+				if err := txn.Delete(repcountIndexKey("surplus", key, oldSurplus)); err != nil {
+					return err
+				}
+			}
+			if err := txn.Set(repcountIndexKey("debt", key, newDebt), []byte{}); err != nil {
+				return err
+			}
+			return txn.Set(repcountIndexKey("surplus", key, newSurplus), []byte{})
+		}
+	})
+}
+
+func (b *badgerMetaStore) Incr(key string, by, def uint64) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var rv uint64
+	err := b.db.Update(func(txn *badger.Txn) error {
+		cur := def
+		item, err := txn.Get([]byte(key))
+		if err == nil {
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			cur, err = strconv.ParseUint(string(v), 10, 64)
+			if err != nil {
+				return err
+			}
+			cur += by
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		rv = cur
+		return txn.Set([]byte(key), []byte(strconv.FormatUint(cur, 10)))
+	})
+	return rv, err
+}
+
+func (b *badgerMetaStore) Get(key string, rv interface{}) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(v, rv)
+	})
+}
+
+func (b *badgerMetaStore) Delete(key string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// Range walks the repcount/<dimension>/<n>/<oid> index, which plays the
+// role of the "repcounts" couchbase view: it lets
+// ensureMinimumReplicaCountTask and pruneExcessiveReplicas find blobs
+// by replica debt/surplus from the index keys alone, without decoding
+// every ownership record. Every index key of the dimension is visited
+// and its count checked against the bounds.
+func (b *badgerMetaStore) Range(q RangeQuery) ([]RangeRow, error) {
+	// unboundedRangeKey marks whichever side of the query wants "no
+	// bound" (see pruneExcessiveReplicas), not just a reversed pair of
+	// real bounds -- ensureMinimumReplicaCountTask legitimately calls
+	// Range with StartKey > EndKey (e.g. StartKey:1, EndKey:0 on a
+	// single-node cluster) meaning "no matches", and blindly swapping
+	// would turn that into a non-empty range instead of agreeing with
+	// couchbaseMetaStore.Range's empty result for the same query.
+	lo, hi := q.StartKey, q.EndKey
+	switch unboundedRangeKey {
+	case q.StartKey:
+		lo, hi = q.EndKey, unboundedRangeKey
+	case q.EndKey:
+		lo, hi = q.StartKey, unboundedRangeKey
+	}
+
+	prefix := "repcount/" + q.Dimension + "/"
+
+	var rows []RangeRow
+	err := b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = q.IncludeDocs
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			k := string(it.Item().Key())
+			parts := strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			n, err := strconv.Atoi(parts[0])
+			if err != nil || n < lo || n > hi {
+				continue
+			}
+
+			row := RangeRow{ID: parts[1]}
+			if q.IncludeDocs {
+				item, err := txn.Get([]byte(parts[1]))
+				if err == nil {
+					doc, err := item.ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+					row.Doc = json.RawMessage(doc)
+				}
+			}
+			rows = append(rows, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	if q.Descending {
+		sort.Slice(rows, func(i, j int) bool { return rows[i].ID > rows[j].ID })
+	}
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+	}
+	return rows, nil
+}
+
+// ReplicaDebt sums the "debt" index's values grouped by blob class,
+// mirroring what the repcounts view's reduce function would report
+// for the couchbase backend.
+func (b *badgerMetaStore) ReplicaDebt() (map[string]int64, error) {
+	rv := map[string]int64{}
+	prefix := []byte("repcount/debt/")
+	err := b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			k := string(it.Item().Key())
+			parts := strings.SplitN(strings.TrimPrefix(k, string(prefix)), "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			n, err := strconv.Atoi(parts[0])
+			if err != nil || n <= 0 {
+				continue
+			}
+			item, err := txn.Get([]byte(parts[1]))
+			if err != nil {
+				continue
+			}
+			doc, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			_, _, class := replicaStats(doc)
+			rv[class] += int64(n)
+		}
+		return nil
+	})
+	return rv, err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestBadgerMetaStore opens a badgerMetaStore against a fresh temp
+// directory and arranges for both to be cleaned up at the end of the
+// test.
+func newTestBadgerMetaStore(t *testing.T) *badgerMetaStore {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "cbfs-badger-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ms, err := newBadgerMetaStore(dir)
+	if err != nil {
+		t.Fatalf("newBadgerMetaStore: %v", err)
+	}
+	b := ms.(*badgerMetaStore)
+	t.Cleanup(func() { b.db.Close() })
+	return b
+}
+
+// putOwnership CAS-writes a complete BlobOwnership record for oid,
+// bypassing recordBlobOwnership so the test can set Nodes/MinRepl/
+// MaxRepl directly without depending on globalConfig.
+func putOwnership(t *testing.T, b *badgerMetaStore, oid string, ownership BlobOwnership) {
+	t.Helper()
+
+	ownership.OID = oid
+	doc, err := json.Marshal(&ownership)
+	if err != nil {
+		t.Fatalf("marshal ownership for %v: %v", oid, err)
+	}
+	if err := b.CAS("/"+oid, func(in []byte) ([]byte, CasOp) {
+		return doc, CASStore
+	}); err != nil {
+		t.Fatalf("CAS(%v): %v", oid, err)
+	}
+}
+
+func rangeIDs(t *testing.T, b *badgerMetaStore, q RangeQuery) []string {
+	t.Helper()
+
+	rows, err := b.Range(q)
+	if err != nil {
+		t.Fatalf("Range(%+v): %v", q, err)
+	}
+	ids := make([]string, 0, len(rows))
+	for _, r := range rows {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+// TestBadgerMetaStoreCASIndexes checks that CAS keeps the
+// repcount/debt and repcount/surplus index keyspaces in sync with each
+// write -- a debt/surplus index entry should exist exactly when, and
+// at exactly the value, replicaStats says it should, and a CASDelete
+// must remove both the record and its index entries together.
+func TestBadgerMetaStoreCASIndexes(t *testing.T) {
+	b := newTestBadgerMetaStore(t)
+
+	// One node against a MinRepl/MaxRepl of 3: debt 2, surplus 0.
+	putOwnership(t, b, "oid1", BlobOwnership{
+		Type:    "blob",
+		MinRepl: 3,
+		MaxRepl: 3,
+		Nodes:   map[string]time.Time{"n1": time.Now().UTC()},
+	})
+	if got := rangeIDs(t, b, RangeQuery{Dimension: "debt", StartKey: 2, EndKey: 2}); len(got) != 1 || got[0] != "/oid1" {
+		t.Fatalf("expected oid1 indexed at debt 2, got %v", got)
+	}
+	if got := rangeIDs(t, b, RangeQuery{Dimension: "surplus", StartKey: 1, EndKey: 5}); len(got) != 0 {
+		t.Fatalf("expected no surplus entries yet, got %v", got)
+	}
+
+	// Grow to 4 nodes against the same MaxRepl of 3: debt should drop
+	// to 0 (and its old index entry be removed) and surplus should
+	// become 1.
+	putOwnership(t, b, "oid1", BlobOwnership{
+		Type:    "blob",
+		MinRepl: 3,
+		MaxRepl: 3,
+		Nodes: map[string]time.Time{
+			"n1": time.Now().UTC(),
+			"n2": time.Now().UTC(),
+			"n3": time.Now().UTC(),
+			"n4": time.Now().UTC(),
+		},
+	})
+	if got := rangeIDs(t, b, RangeQuery{Dimension: "debt", StartKey: 1, EndKey: 5}); len(got) != 0 {
+		t.Fatalf("expected oid1's stale debt-2 index entry to be gone, got %v", got)
+	}
+	if got := rangeIDs(t, b, RangeQuery{Dimension: "surplus", StartKey: 1, EndKey: 5}); len(got) != 1 || got[0] != "/oid1" {
+		t.Fatalf("expected oid1 indexed at surplus 1, got %v", got)
+	}
+
+	// CASDelete must remove the surplus index entry along with the
+	// record itself.
+	if err := b.CAS("/oid1", func(in []byte) ([]byte, CasOp) {
+		return nil, CASDelete
+	}); err != nil {
+		t.Fatalf("CAS delete: %v", err)
+	}
+	if got := rangeIDs(t, b, RangeQuery{Dimension: "surplus", StartKey: 1, EndKey: 5}); len(got) != 0 {
+		t.Fatalf("expected surplus index entry to be cleaned up after delete, got %v", got)
+	}
+	if got := rangeIDs(t, b, RangeQuery{Dimension: "debt", StartKey: 0, EndKey: 5}); len(got) != 0 {
+		t.Fatalf("expected debt index entry to be cleaned up after delete, got %v", got)
+	}
+	if err := b.Get("/oid1", &BlobOwnership{}); err == nil {
+		t.Fatalf("expected /oid1 record to be gone after delete")
+	}
+}
+
+// TestBadgerMetaStoreRangeUnboundedSentinel exercises the StartKey/
+// EndKey bounds ensureMinimumReplicaCountTask and pruneExcessiveReplicas
+// pass to Range, plus an EndKey-as-sentinel range that neither issues,
+// including the single-node-cluster case
+// (StartKey 1, EndKey 0) that must return no rows rather than being
+// swapped into the real range [0, 1].
+func TestBadgerMetaStoreRangeUnboundedSentinel(t *testing.T) {
+	b := newTestBadgerMetaStore(t)
+
+	// debt 0, surplus 0.
+	putOwnership(t, b, "even", BlobOwnership{
+		Type: "blob", MinRepl: 1, MaxRepl: 1,
+		Nodes: map[string]time.Time{"n1": time.Now().UTC()},
+	})
+	// debt 1, surplus 0.
+	putOwnership(t, b, "underreplicated", BlobOwnership{
+		Type: "blob", MinRepl: 2, MaxRepl: 2,
+		Nodes: map[string]time.Time{"n1": time.Now().UTC()},
+	})
+	// debt 0, surplus 1.
+	putOwnership(t, b, "overreplicated", BlobOwnership{
+		Type: "blob", MinRepl: 1, MaxRepl: 1,
+		Nodes: map[string]time.Time{"n1": time.Now().UTC(), "n2": time.Now().UTC()},
+	})
+
+	tests := []struct {
+		name string
+		q    RangeQuery
+		want []string
+	}{
+		{
+			name: "single-node cluster: StartKey 1, EndKey len(nl)-1==0 finds nothing",
+			q:    RangeQuery{Dimension: "debt", StartKey: 1, EndKey: 0},
+			want: nil,
+		},
+		{
+			name: "ordinary bounded range still finds the under-replicated blob",
+			q:    RangeQuery{Dimension: "debt", StartKey: 1, EndKey: 5},
+			want: []string{"/underreplicated"},
+		},
+		{
+			name: "EndKey as the unbounded sentinel",
+			q:    RangeQuery{Dimension: "debt", StartKey: 1, EndKey: unboundedRangeKey},
+			want: []string{"/underreplicated"},
+		},
+		{
+			name: "StartKey as the unbounded sentinel (pruneExcessiveReplicas' surplus scan)",
+			q:    RangeQuery{Dimension: "surplus", StartKey: unboundedRangeKey, EndKey: 1},
+			want: []string{"/overreplicated"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rangeIDs(t, b, tt.q)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
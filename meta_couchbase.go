@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+)
+
+// couchbaseMetaStore is the original MetaStore implementation, backed by
+// the cluster-wide `couchbase` bucket. It's just a thin wrapper around
+// the couchbase.Do/CAS/Get/Incr/ViewCustom calls blobs.go used to make
+// directly.
+type couchbaseMetaStore struct{}
+
+func newCouchbaseMetaStore() MetaStore {
+	return couchbaseMetaStore{}
+}
+
+func toMemcachedOp(op CasOp) memcached.CasOp {
+	switch op {
+	case CASDelete:
+		return memcached.CASDelete
+	case CASQuit:
+		return memcached.CASQuit
+	default:
+		return memcached.CASStore
+	}
+}
+
+func (couchbaseMetaStore) CAS(key string, f func(in []byte) ([]byte, CasOp)) error {
+	err := couchbase.Do(key, func(mc *memcached.Client, vb uint16) error {
+		_, err := mc.CAS(vb, key, func(in []byte) ([]byte, memcached.CasOp) {
+			out, op := f(in)
+			return out, toMemcachedOp(op)
+		}, 0)
+		return err
+	})
+	if err == memcached.CASQuit {
+		err = nil
+	}
+	return err
+}
+
+func (couchbaseMetaStore) Incr(key string, by, def uint64) (uint64, error) {
+	return couchbase.Incr(key, by, def, 0)
+}
+
+func (couchbaseMetaStore) Get(key string, rv interface{}) error {
+	return couchbase.Get(key, rv)
+}
+
+func (couchbaseMetaStore) Delete(key string) error {
+	err := couchbase.Delete(key)
+	if res, ok := err.(*gomemcached.MCResponse); ok && res.Status == gomemcached.KEY_ENOENT {
+		return nil
+	}
+	return err
+}
+
+// The repcounts view emits one row per blob per dimension:
+//   emit(["debt", Math.max(0, desired(doc, "min") - actual)],
+//        {[doc.type]: Math.max(0, desired(doc, "min") - actual)})
+//   emit(["surplus", Math.max(0, actual - desired(doc, "max"))],
+//        {[doc.type]: Math.max(0, actual - desired(doc, "max"))})
+// keyed as [dimension, value] so a range query can ask for, say, every
+// blob with debt between 1 and N without caring what each blob's
+// individual MinRepl/MaxRepl override was. The emitted value is a
+// single-key {class: amount} object rather than a bare number so the
+// view's built-in _sum reduce -- which merges same-named keys across
+// objects -- can report per-class totals (ReplicaDebt) without needing
+// class in the key, which would otherwise break the value-range scan
+// Range relies on.
+
+func (couchbaseMetaStore) Range(q RangeQuery) ([]RangeRow, error) {
+	viewRes := struct {
+		Rows []struct {
+			Id  string
+			Doc struct {
+				Json json.RawMessage
+			} `json:"doc,omitempty"`
+		}
+	}{}
+
+	params := map[string]interface{}{
+		"reduce":       false,
+		"limit":        q.Limit,
+		"endkey":       []interface{}{q.Dimension, q.EndKey},
+		"descending":   q.Descending,
+		"include_docs": q.IncludeDocs,
+		"stale":        false,
+	}
+	// unboundedRangeKey means "don't constrain this side of the
+	// range" -- just omit startkey rather than asking the view for a
+	// literal key that large.
+	if q.StartKey != unboundedRangeKey {
+		params["startkey"] = []interface{}{q.Dimension, q.StartKey}
+	}
+
+	err := couchbase.ViewCustom("cbfs", "repcounts", params, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]RangeRow, 0, len(viewRes.Rows))
+	for _, r := range viewRes.Rows {
+		row := RangeRow{ID: r.Id}
+		if q.IncludeDocs {
+			row.Doc = r.Doc.Json
+		}
+		rv = append(rv, row)
+	}
+	return rv, nil
+}
+
+// ReplicaDebt uses the repcounts view's reduce function (couchbase's
+// built-in _sum, grouped down to just the "debt" dimension) to report
+// cluster-wide replica debt grouped by blob class (BlobOwnership.Type).
+func (couchbaseMetaStore) ReplicaDebt() (map[string]int64, error) {
+	viewRes := struct {
+		Rows []struct {
+			Value map[string]int64
+		}
+	}{}
+
+	err := couchbase.ViewCustom("cbfs", "repcounts",
+		map[string]interface{}{
+			"reduce":      true,
+			"group_level": 1,
+			"startkey":    []interface{}{"debt"},
+			"endkey":      []interface{}{"debt", map[string]interface{}{}},
+			"stale":       false,
+		},
+		&viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := map[string]int64{}
+	for _, r := range viewRes.Rows {
+		for class, amount := range r.Value {
+			rv[class] += amount
+		}
+	}
+	return rv, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+)
+
+// CasOp describes the outcome a MetaStore.CAS callback wants applied,
+// mirroring the quit/store/delete sentinel memcached.CasOp already
+// expresses for the couchbase backend.
+type CasOp int
+
+const (
+	CASStore = CasOp(iota)
+	CASDelete
+	CASQuit
+)
+
+// unboundedRangeKey is used in place of a real StartKey/EndKey when a
+// caller wants one side of a Range query to mean "no bound", e.g. a
+// descending scan that should include every over-replicated blob
+// regardless of how high its count goes.
+const unboundedRangeKey = 1 << 30
+
+// RangeQuery describes a ranged lookup over the replica-count index, as
+// used by ensureMinimumReplicaCountTask and pruneExcessiveReplicas.
+//
+// Dimension selects which per-blob quantity is indexed: "debt" is
+// max(0, desired-actual), used to find under-replicated blobs, and
+// "surplus" is max(0, actual-desired), used to find over-replicated
+// ones. "desired" comes from BlobOwnership.MinRepl/MaxRepl when set,
+// falling back to globalConfig.MinReplicas/MaxReplicas otherwise, so
+// blobs with a per-object override are found by the same query as
+// everything else.
+type RangeQuery struct {
+	Dimension   string
+	StartKey    int
+	EndKey      int
+	Limit       int
+	Descending  bool
+	IncludeDocs bool
+}
+
+// RangeRow is a single result from MetaStore.Range. Doc is only populated
+// when the query asked for IncludeDocs.
+type RangeRow struct {
+	ID  string
+	Doc json.RawMessage
+}
+
+// MetaStore abstracts the bits of BlobOwnership persistence that today
+// talk directly to couchbase: CAS-protected read-modify-write, simple
+// counters, and the "blobs with replica count between X and Y" range
+// query that drives replication repair.
+type MetaStore interface {
+	// CAS performs a read-modify-write of key, retrying internally on
+	// conflict. f is handed the current value (nil if the key doesn't
+	// exist) and returns the new value to store along with the CasOp
+	// to apply.
+	CAS(key string, f func(in []byte) ([]byte, CasOp)) error
+
+	// Incr atomically increments key by by, creating it with def if
+	// absent, and returns the resulting value.
+	Incr(key string, by, def uint64) (uint64, error)
+
+	// Get unmarshals the value stored at key into rv.
+	Get(key string, rv interface{}) error
+
+	// Delete removes key. It is not an error for key to be absent.
+	Delete(key string) error
+
+	// Range returns blobs whose replica-count index falls within q,
+	// in place of the "repcounts" couchbase view.
+	Range(q RangeQuery) ([]RangeRow, error)
+
+	// ReplicaDebt reports cluster-wide replica debt (sum of desired
+	// minus actual, for blobs that are under-replicated) grouped by
+	// BlobOwnership.Type, in place of the "repcounts" reduce view.
+	ReplicaDebt() (map[string]int64, error)
+}
+
+var metaStoreBackend = flag.String("metaStoreBackend", "couchbase",
+	"Metadata backend to use (couchbase or badger).")
+
+var badgerPath = flag.String("badgerPath", "",
+	"Path to the embedded badger database (badger backend only).")
+
+var metaStore MetaStore
+
+// initMetaStore selects and initializes the configured MetaStore
+// backend. It must be called once during startup before any code
+// touches BlobOwnership records.
+func initMetaStore() error {
+	switch *metaStoreBackend {
+	case "couchbase":
+		metaStore = newCouchbaseMetaStore()
+		return nil
+	case "badger":
+		ms, err := newBadgerMetaStore(*badgerPath)
+		if err != nil {
+			return err
+		}
+		metaStore = ms
+		return nil
+	default:
+		return fmt.Errorf("unknown metaStoreBackend: %v", *metaStoreBackend)
+	}
+}
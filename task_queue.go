@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Priority classifies internode tasks so urgent work (dead-node
+// salvage, under-min-replica repair) can't get stuck behind a pile of
+// speculative rebalance/prune work.
+type Priority int
+
+const (
+	PriorityCritical Priority = iota
+	PriorityNormal
+	PriorityBackground
+
+	numPriorities = int(PriorityBackground) + 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityCritical:
+		return "critical"
+	case PriorityNormal:
+		return "normal"
+	case PriorityBackground:
+		return "background"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+// ErrQueueFull is returned by queueBlobAcquire/queueBlobRemoval/
+// queueBlobFetch when the requested lane is at capacity, so callers
+// like salvageBlob can fall back to a different node instead of
+// blocking indefinitely.
+type ErrQueueFull struct {
+	Priority Priority
+}
+
+func (e ErrQueueFull) Error() string {
+	return fmt.Sprintf("%v lane is full", e.Priority)
+}
+
+type internodeCommand uint8
+
+const (
+	removeObjectCmd = internodeCommand(iota)
+	acquireObjectCmd
+	fetchObjectCmd
+)
+
+type internodeTask struct {
+	ctx      context.Context
+	node     StorageNode
+	cmd      internodeCommand
+	oid      string
+	prevNode string
+}
+
+var taskWorkers = flag.Int("taskWorkers", 4,
+	"Number of blob move/removal workers.")
+
+var laneDepths = [numPriorities]int{
+	PriorityCritical:   200,
+	PriorityNormal:     500,
+	PriorityBackground: 1000,
+}
+
+// taskLanes holds one bounded channel per priority. Lower-indexed
+// lanes are preferred by the worker's selection loop, except for the
+// periodic background turn described at backgroundQuota.
+var taskLanes = [numPriorities]chan internodeTask{
+	PriorityCritical:   make(chan internodeTask, laneDepths[PriorityCritical]),
+	PriorityNormal:     make(chan internodeTask, laneDepths[PriorityNormal]),
+	PriorityBackground: make(chan internodeTask, laneDepths[PriorityBackground]),
+}
+
+// inFlight counts tasks currently being executed (not just queued) per
+// lane, for monitoring.
+var inFlight [numPriorities]int32
+
+// QueueStats is a point-in-time snapshot of one lane's depth and
+// in-flight count, for monitoring.
+type QueueStats struct {
+	Priority Priority
+	Depth    int
+	Capacity int
+	InFlight int32
+}
+
+// TaskQueueStats reports depth/capacity/in-flight counts for every
+// lane, for an admin status endpoint.
+func TaskQueueStats() []QueueStats {
+	stats := make([]QueueStats, numPriorities)
+	for p := 0; p < numPriorities; p++ {
+		stats[p] = QueueStats{
+			Priority: Priority(p),
+			Depth:    len(taskLanes[p]),
+			Capacity: cap(taskLanes[p]),
+			InFlight: atomic.LoadInt32(&inFlight[p]),
+		}
+	}
+	return stats
+}
+
+func enqueue(p Priority, t internodeTask) error {
+	select {
+	case taskLanes[p] <- t:
+		return nil
+	default:
+		return ErrQueueFull{Priority: p}
+	}
+}
+
+func queueBlobRemoval(ctx context.Context, p Priority, n StorageNode, oid string) error {
+	return enqueue(p, internodeTask{
+		ctx:  ctx,
+		node: n,
+		cmd:  removeObjectCmd,
+		oid:  oid,
+	})
+}
+
+// Ask a remote node to go get a blob
+func queueBlobAcquire(ctx context.Context, p Priority, n StorageNode, oid string, prev string) error {
+	return enqueue(p, internodeTask{
+		ctx:      ctx,
+		node:     n,
+		cmd:      acquireObjectCmd,
+		oid:      oid,
+		prevNode: prev,
+	})
+}
+
+// Ask this node to go get a blob
+func queueBlobFetch(ctx context.Context, p Priority, oid, prev string) error {
+	return enqueue(p, internodeTask{
+		ctx:      ctx,
+		cmd:      fetchObjectCmd,
+		oid:      oid,
+		prevNode: prev,
+	})
+}
+
+func runInternodeTask(c internodeTask) {
+	switch c.cmd {
+	case removeObjectCmd:
+		if err := c.node.deleteBlob(c.ctx, c.oid); err != nil {
+			log.Printf("Error deleting %v from %v: %v",
+				c.oid, c.node, err)
+			if c.node.IsDead() {
+				log.Printf("Node is dead, cleaning")
+				removeBlobOwnershipRecord(c.oid, c.node.name)
+			}
+		}
+	case acquireObjectCmd:
+		if err := c.node.acquireBlob(c.ctx, c.oid, c.prevNode); err != nil {
+			log.Printf("Error acquiring %v from %v: %v",
+				c.oid, c.node, err)
+		}
+	case fetchObjectCmd:
+		performFetch(c.ctx, c.oid, c.prevNode)
+	default:
+		log.Fatalf("Unhandled worker task: %v", c)
+	}
+}
+
+// backgroundQuota bounds how many critical/normal tasks a worker will
+// service before it forces a non-blocking turn for the background
+// lane. Without this, a prolonged run of critical traffic (e.g. a
+// dead-node salvage storm) would keep the strict-priority checks below
+// from ever reaching background, starving it completely instead of
+// merely deprioritizing it.
+const backgroundQuota = 8
+
+// internodeTaskWorker drains taskLanes until parent is cancelled. It
+// prefers a lower-priority-number lane when it has work -- checking
+// critical non-blockingly, then critical+normal non-blockingly, and
+// only blocking across all three when nothing higher is ready -- but
+// every backgroundQuota critical/normal tasks it services, it forces a
+// non-blocking check of the background lane first. That guarantees
+// critical work is never stuck behind normal/background work, while
+// still letting background make forward progress even when critical
+// traffic never lets up.
+func internodeTaskWorker(parent context.Context) {
+	sinceBackground := 0
+	for {
+		if sinceBackground >= backgroundQuota {
+			select {
+			case <-parent.Done():
+				return
+			case t := <-taskLanes[PriorityBackground]:
+				runTaskTimed(PriorityBackground, t)
+				sinceBackground = 0
+				continue
+			default:
+			}
+		}
+
+		select {
+		case <-parent.Done():
+			return
+		case t := <-taskLanes[PriorityCritical]:
+			runTaskTimed(PriorityCritical, t)
+			sinceBackground++
+			continue
+		default:
+		}
+
+		select {
+		case <-parent.Done():
+			return
+		case t := <-taskLanes[PriorityCritical]:
+			runTaskTimed(PriorityCritical, t)
+			sinceBackground++
+			continue
+		case t := <-taskLanes[PriorityNormal]:
+			runTaskTimed(PriorityNormal, t)
+			sinceBackground++
+			continue
+		default:
+		}
+
+		select {
+		case <-parent.Done():
+			return
+		case t := <-taskLanes[PriorityCritical]:
+			runTaskTimed(PriorityCritical, t)
+			sinceBackground++
+		case t := <-taskLanes[PriorityNormal]:
+			runTaskTimed(PriorityNormal, t)
+			sinceBackground++
+		case t := <-taskLanes[PriorityBackground]:
+			runTaskTimed(PriorityBackground, t)
+			sinceBackground = 0
+		}
+	}
+}
+
+func runTaskTimed(p Priority, t internodeTask) {
+	if t.ctx.Err() != nil {
+		log.Printf("Skipping cancelled %v task for %v", p, t.oid)
+		return
+	}
+	atomic.AddInt32(&inFlight[p], 1)
+	defer atomic.AddInt32(&inFlight[p], -1)
+	runInternodeTask(t)
+}
+
+func initTaskQueueWorkers(parent context.Context) {
+	for i := 0; i < *taskWorkers; i++ {
+		go internodeTaskWorker(parent)
+	}
+}
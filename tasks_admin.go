@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// adminTasks tracks the cancel funcs for currently-running cancellable
+// tasks (ensureMinReplCount, pruneExcessiveReplicas, ...) so an
+// operator can abort a long-running rebalance without killing the
+// process.
+var adminTasks = struct {
+	mu sync.Mutex
+	m  map[string]context.CancelFunc
+}{m: map[string]context.CancelFunc{}}
+
+// registerAdminTask derives a cancellable context for a named task and
+// makes it discoverable to doCancelTask. The returned cancel func must
+// be deferred by the caller; it both stops the task's context and
+// removes it from the registry.
+func registerAdminTask(name string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	adminTasks.mu.Lock()
+	adminTasks.m[name] = cancel
+	adminTasks.mu.Unlock()
+
+	return ctx, func() {
+		cancel()
+		adminTasks.mu.Lock()
+		delete(adminTasks.m, name)
+		adminTasks.mu.Unlock()
+	}
+}
+
+// cancelAdminTask cancels the context of the named running task, if
+// any. It reports whether a task by that name was found.
+func cancelAdminTask(name string) bool {
+	adminTasks.mu.Lock()
+	cancel, ok := adminTasks.m[name]
+	adminTasks.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// doCancelTask handles POST /.cbfs/tasks/cancel/<name>, cancelling a
+// running admin task by name.
+func doCancelTask(w http.ResponseWriter, req *http.Request, name string) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !cancelAdminTask(name) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no running task named %q", name)
+		return
+	}
+
+	log.Printf("Cancelled task %v by admin request", name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"cancelled": name})
+}